@@ -2,11 +2,16 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -18,16 +23,72 @@ const (
 var (
 	defaultFreq          = 3 * time.Second
 	defaultLookupTimeout = 10 * time.Second
-)
 
-// onRefreshed is called when DNS are refreshed.
-var onRefreshed = func() {}
+	// defaultTTL is how long a successful lookup is considered fresh.
+	defaultTTL = 5 * time.Minute
+	// defaultNegativeTTL is how long a failed lookup (e.g. NXDOMAIN) is cached
+	// before being retried, so PersistOnFailure behavior is explicit rather
+	// than retrying a broken name on every single Fetch.
+	defaultNegativeTTL = 10 * time.Second
+	// defaultGraceWindow is how long past expiry a stale entry is still
+	// served from Fetch while a refresh happens asynchronously in the background.
+	defaultGraceWindow = 30 * time.Second
+	// defaultIdleWindow is how long an entry can go unused before Refresh evicts it.
+	defaultIdleWindow = 10 * time.Minute
+	// defaultMaxEntries caps the cache size; Refresh evicts the least
+	// recently used entries once this is exceeded.
+	defaultMaxEntries = 10000
+)
 
 type DNSCache interface {
 	LookupIP(ctx context.Context, addr string) ([]net.IP, error)
 	Fetch(ctx context.Context, addr string) ([]net.IP, error)
 	Refresh()
 	Stop()
+	Invalidate(addr string)
+}
+
+// cacheEntry is a single resolved (or failed) lookup kept in the Resolver cache.
+type cacheEntry struct {
+	ips       []net.IP
+	err       error
+	expiresAt time.Time
+
+	// lastUsed is a UnixNano timestamp updated atomically on every access,
+	// since entries live in a sync.Map and are shared across readers without
+	// a lock.
+	lastUsed int64
+
+	// refreshing is set via atomic CompareAndSwap while a background grace-
+	// window refresh for this entry is in flight, so a popular host doesn't
+	// spawn one goroutine per concurrent Fetch.
+	refreshing int32
+}
+
+// expired reports whether the entry is past its TTL as of now.
+func (e *cacheEntry) expired(now time.Time) bool {
+	return now.After(e.expiresAt)
+}
+
+// touch records now as the entry's last-used time.
+func (e *cacheEntry) touch(now time.Time) {
+	atomic.StoreInt64(&e.lastUsed, now.UnixNano())
+}
+
+// lastUsedAt returns the last-used time recorded by touch.
+func (e *cacheEntry) lastUsedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&e.lastUsed))
+}
+
+// startRefresh claims the entry's in-flight refresh slot, returning false if
+// a refresh is already running.
+func (e *cacheEntry) startRefresh() bool {
+	return atomic.CompareAndSwapInt32(&e.refreshing, 0, 1)
+}
+
+// finishRefresh releases the in-flight refresh slot.
+func (e *cacheEntry) finishRefresh() {
+	atomic.StoreInt32(&e.refreshing, 0)
 }
 
 // Resolver is DNS cache resolver which cache DNS resolve results in memory.
@@ -35,16 +96,110 @@ type Resolver struct {
 	lookupIPFn    func(ctx context.Context, host string) ([]net.IP, error)
 	lookupTimeout time.Duration
 
-	logger *logrus.Logger
+	// ttl is how long a successful lookup stays fresh; negativeTTL is the
+	// (usually much shorter) equivalent for failed lookups.
+	ttl         time.Duration
+	negativeTTL time.Duration
+	// graceWindow is how long past expiry a stale entry is still served
+	// from Fetch while a refresh is triggered asynchronously.
+	graceWindow time.Duration
+	// idleWindow and maxEntries bound cache growth: Refresh evicts entries
+	// unused for longer than idleWindow, then trims down to maxEntries
+	// by least-recently-used if the cache is still over budget.
+	idleWindow time.Duration
+	maxEntries int
+
+	logger  *logrus.Logger
+	metrics Metrics
+
+	// onRefresh, if set via OnRefresh, is called with the outcome of every
+	// per-host refresh. Stored in an atomic.Value since it can be registered
+	// concurrently with the background refresh goroutine.
+	onRefresh atomic.Value
+
+	// sf coalesces concurrent lookups for the same host so a cache miss
+	// under load triggers a single DNS query instead of a stampede.
+	sf singleflight.Group
 
-	lock   sync.RWMutex
-	cache  map[string][]net.IP
+	// sfInFlight counts, per addr, how many resolve calls are currently
+	// waiting on that addr's singleflight group. It's used to attribute
+	// IncSingleflightDedup only to callers that joined an already-in-flight
+	// lookup, since sf.Do's own "shared" result is identical for the leader
+	// and every follower.
+	sfInFlight sync.Map
+
+	// cache is a sync.Map of addr -> *cacheEntry. It replaces a mutex-guarded
+	// map so the hot Fetch path never blocks on a lock under high proxy
+	// concurrency; entries are immutable except for the atomic lastUsed and
+	// refreshing fields.
+	cache sync.Map
+
+	lock   sync.Mutex
 	closer func()
 }
 
+// refreshCallback wraps a RefreshStats callback so it can be stored in an
+// atomic.Value, which requires a consistent concrete type across Store calls.
+type refreshCallback struct {
+	fn func(stats RefreshStats)
+}
+
+// OnRefresh registers fn to be called with the outcome of every per-host
+// cache refresh (old IPs, new IPs, error), replacing any previously
+// registered callback. Safe to call concurrently with Refresh.
+func (r *Resolver) OnRefresh(fn func(stats RefreshStats)) {
+	r.onRefresh.Store(refreshCallback{fn: fn})
+}
+
+func (r *Resolver) reportRefresh(stats RefreshStats) {
+	v, ok := r.onRefresh.Load().(refreshCallback)
+	if !ok || v.fn == nil {
+		return
+	}
+	v.fn(stats)
+}
+
+// ResolverConfig configures the `*net.Resolver` a Resolver looks up through.
+// It is consulted once, in NewDNSResolver.
+type ResolverConfig struct {
+	// PreferGo forces use of the pure Go resolver instead of the cgo/OS
+	// resolver, which is required in CGO_ENABLED=0 and FIPS builds.
+	PreferGo bool
+	// Dial, if set, is used to contact the upstream DNS server instead of the
+	// OS default, e.g. to pin resolution to "1.1.1.1:53" or a pod-local
+	// resolver. It implies PreferGo, since only the pure Go resolver uses it.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// IPv4Only and IPv6Only restrict lookups to a single address family.
+	// Setting both is treated as neither being set.
+	IPv4Only bool
+	IPv6Only bool
+}
+
+// filterIPsByFamily returns the subset of ips matching the requested address
+// family. Setting both ipv4Only and ipv6Only is treated as neither being set.
+func filterIPsByFamily(ips []net.IP, ipv4Only, ipv6Only bool) []net.IP {
+	if ipv4Only == ipv6Only {
+		return ips
+	}
+
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		if ipv4Only && !isV4 {
+			continue
+		}
+		if ipv6Only && isV4 {
+			continue
+		}
+		filtered = append(filtered, ip)
+	}
+	return filtered
+}
+
 // NewDNSResolver initializes DNS cache resolver and starts auto refreshing in a new goroutine.
-// To stop refreshing, call `Stop()` function.
-func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, resolver *net.Resolver, logger *logrus.Logger) (DNSCache, error) {
+// To stop refreshing, call `Stop()` function. Pass a nil metrics to skip
+// instrumentation.
+func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, cfg ResolverConfig, logger *logrus.Logger, metrics Metrics) (DNSCache, error) {
 	if freq <= 0 {
 		freq = defaultFreq
 	}
@@ -53,6 +208,18 @@ func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, resolver *n
 		lookupTimeout = defaultLookupTimeout
 	}
 
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+
+	resolver := &net.Resolver{
+		// Dial is only consulted by the pure Go resolver, so force PreferGo
+		// when it's set -- otherwise the cgo/OS resolver would silently
+		// ignore it.
+		PreferGo: cfg.PreferGo || cfg.Dial != nil,
+		Dial:     cfg.Dial,
+	}
+
 	ticker := time.NewTicker(freq)
 	ch := make(chan struct{})
 	closer := func() {
@@ -60,8 +227,6 @@ func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, resolver *n
 		close(ch)
 	}
 
-	// copy handler function to avoid race
-	onRefreshedFn := onRefreshed
 	lookupIPFn := func(ctx context.Context, host string) ([]net.IP, error) {
 		addrs, err := resolver.LookupIPAddr(ctx, host)
 
@@ -69,20 +234,25 @@ func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, resolver *n
 			return nil, err
 		}
 
-		ips := make([]net.IP, len(addrs))
-		for i, ia := range addrs {
-			ips[i] = ia.IP
+		ips := make([]net.IP, 0, len(addrs))
+		for _, ia := range addrs {
+			ips = append(ips, ia.IP)
 		}
 
-		return ips, nil
+		return filterIPsByFamily(ips, cfg.IPv4Only, cfg.IPv6Only), nil
 	}
 
 	r := &Resolver{
 		lookupIPFn:    lookupIPFn,
 		lookupTimeout: lookupTimeout,
-		cache:         make(map[string][]net.IP, cacheSize),
+		ttl:           defaultTTL,
+		negativeTTL:   defaultNegativeTTL,
+		graceWindow:   defaultGraceWindow,
+		idleWindow:    defaultIdleWindow,
+		maxEntries:    defaultMaxEntries,
 		closer:        closer,
 		logger:        logger,
+		metrics:       metrics,
 	}
 
 	go func() {
@@ -90,7 +260,6 @@ func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, resolver *n
 			select {
 			case <-ticker.C:
 				r.Refresh()
-				onRefreshedFn()
 			case <-ch:
 				return
 			}
@@ -100,44 +269,192 @@ func NewDNSResolver(freq time.Duration, lookupTimeout time.Duration, resolver *n
 	return r, nil
 }
 
+// resolveResult is the outcome of a single coalesced lookup. servedIPs/
+// servedErr are what Fetch/LookupIP callers are given for this lookup, which
+// can differ from the raw DNS outcome: a failed refresh with a usable prior
+// entry serves the old IPs instead of the error (persist-on-failure).
+// lookupIPs/lookupErr are the raw lookupIPFn outcome and are always reported
+// to refreshHost's metrics/RefreshStats, regardless of what was served.
+type resolveResult struct {
+	servedIPs []net.IP
+	servedErr error
+	lookupIPs []net.IP
+	lookupErr error
+}
+
+// resolve performs the actual DNS lookup for addr, coalescing concurrent
+// callers for the same addr into a single in-flight request, and stores the
+// outcome in the cache with the appropriate TTL.
+func (r *Resolver) resolve(ctx context.Context, addr string) ([]net.IP, error) {
+	res := r.doResolve(ctx, addr)
+	return res.servedIPs, res.servedErr
+}
+
+// doResolve is the shared implementation behind resolve and refreshHost. It
+// returns the full resolveResult so refreshHost can see the true lookup
+// outcome even when a failure is masked from callers by persist-on-failure.
+func (r *Resolver) doResolve(ctx context.Context, addr string) resolveResult {
+	counterI, _ := r.sfInFlight.LoadOrStore(addr, new(int32))
+	counter := counterI.(*int32)
+	if atomic.AddInt32(counter, 1) > 1 {
+		r.metrics.IncSingleflightDedup()
+	}
+	defer func() {
+		// Once the counter drops back to zero there's no caller left waiting
+		// on addr, so drop its entry -- otherwise sfInFlight grows by one
+		// entry per distinct hostname ever queried and never shrinks.
+		if atomic.AddInt32(counter, -1) <= 0 {
+			r.sfInFlight.Delete(addr)
+		}
+	}()
+
+	v, _, _ := r.sf.Do(addr, func() (interface{}, error) {
+		r.metrics.IncLookups()
+		start := time.Now()
+		ips, lookupErr := r.lookupIPFn(ctx, addr)
+		r.metrics.ObserveLookupDuration(time.Since(start))
+
+		// A canceled or timed-out lookup reflects the caller's context, not
+		// the host's health, so it's never cached -- otherwise a single
+		// client hangup would negatively cache a perfectly healthy host for
+		// the full negativeTTL.
+		if errors.Is(lookupErr, context.Canceled) || errors.Is(lookupErr, context.DeadlineExceeded) {
+			return resolveResult{lookupErr: lookupErr, servedErr: lookupErr}, nil
+		}
+
+		now := time.Now()
+		if lookupErr != nil {
+			if prev, ok := r.cache.Load(addr); ok {
+				if old := prev.(*cacheEntry); len(old.ips) > 0 {
+					// Persist-on-failure: keep serving the last good answer
+					// instead of overwriting it with the error, retrying
+					// again after negativeTTL.
+					entry := &cacheEntry{ips: old.ips, expiresAt: now.Add(r.negativeTTL)}
+					entry.touch(now)
+					r.cache.Store(addr, entry)
+					return resolveResult{servedIPs: entry.ips, lookupErr: lookupErr}, nil
+				}
+			}
+
+			entry := &cacheEntry{err: lookupErr, expiresAt: now.Add(r.negativeTTL)}
+			entry.touch(now)
+			r.cache.Store(addr, entry)
+			return resolveResult{servedErr: lookupErr, lookupErr: lookupErr}, nil
+		}
+
+		entry := &cacheEntry{ips: ips, expiresAt: now.Add(r.ttl)}
+		entry.touch(now)
+		r.cache.Store(addr, entry)
+
+		return resolveResult{servedIPs: ips, lookupIPs: ips}, nil
+	})
+	return v.(resolveResult)
+}
+
 // LookupIP lookups IP list from DNS server then it saves result in the cache.
 // If you want to get result from the cache use `Fetch` function.
 func (r *Resolver) LookupIP(ctx context.Context, addr string) ([]net.IP, error) {
-	ips, err := r.lookupIPFn(ctx, addr)
-	if err != nil {
-		return nil, err
+	return r.resolve(ctx, addr)
+}
+
+// Fetch fetches IP list from the cache. If the given addr isn't cached yet it
+// is looked up synchronously. A cached entry within its grace window past TTL
+// is returned as-is while a refresh for it is kicked off in the background.
+func (r *Resolver) Fetch(ctx context.Context, addr string) ([]net.IP, error) {
+	now := time.Now()
+
+	v, ok := r.cache.Load(addr)
+	if !ok {
+		r.metrics.IncCacheMiss()
+		return r.resolve(ctx, addr)
 	}
+	entry := v.(*cacheEntry)
+	entry.touch(now)
 
-	r.lock.Lock()
-	r.cache[addr] = ips
-	r.lock.Unlock()
-	return ips, nil
+	if !entry.expired(now) {
+		r.metrics.IncCacheHit()
+		return entry.ips, entry.err
+	}
+
+	if now.Before(entry.expiresAt.Add(r.graceWindow)) {
+		r.metrics.IncCacheHit()
+		if entry.startRefresh() {
+			go func() {
+				defer entry.finishRefresh()
+				ctx, cancelF := context.WithTimeout(context.Background(), r.lookupTimeout)
+				defer cancelF()
+				if err := r.refreshHost(ctx, addr); err != nil {
+					r.logger.WithFields(logrus.Fields{
+						"error": err,
+						"addr":  addr,
+					}).Error("failed to refresh DNS cache")
+				}
+			}()
+		}
+		return entry.ips, entry.err
+	}
+
+	r.metrics.IncCacheMiss()
+	return r.resolve(ctx, addr)
 }
 
-// Fetch fetches IP list from the cache. If IP list of the given addr is not in the cache,
-// then it lookups from DNS server by `Lookup` function.
-func (r *Resolver) Fetch(ctx context.Context, addr string) ([]net.IP, error) {
-	r.lock.RLock()
-	ips, ok := r.cache[addr]
-	r.lock.RUnlock()
-	if ok {
-		return ips, nil
+// refreshHost re-resolves addr, reporting the old/new IPs and any error both
+// to metrics and to the callback registered with OnRefresh. It reports the
+// true underlying lookup outcome even when a failure was masked from Fetch/
+// LookupIP callers by persist-on-failure, so refresh metrics and RefreshStats
+// reflect DNS health rather than what's being served from a stale cache.
+func (r *Resolver) refreshHost(ctx context.Context, addr string) error {
+	var oldIPs []net.IP
+	var old *cacheEntry
+	if v, ok := r.cache.Load(addr); ok {
+		old = v.(*cacheEntry)
+		oldIPs = old.ips
+	}
+
+	res := r.doResolve(ctx, addr)
+
+	// A refresh is not a use: carry the old entry's last-used time over to its
+	// replacement so idle eviction and LRU ordering only see real accesses.
+	if v, ok := r.cache.Load(addr); ok && old != nil {
+		if entry := v.(*cacheEntry); entry != old {
+			stored := atomic.LoadInt64(&entry.lastUsed)
+			if prev := atomic.LoadInt64(&old.lastUsed); prev < stored {
+				atomic.CompareAndSwapInt64(&entry.lastUsed, stored, prev)
+			}
+		}
 	}
-	return r.LookupIP(ctx, addr)
+
+	if res.lookupErr != nil {
+		r.metrics.IncRefreshFailure()
+	} else {
+		r.metrics.IncRefreshSuccess()
+	}
+
+	r.reportRefresh(RefreshStats{Host: addr, OldIPs: oldIPs, NewIPs: res.lookupIPs, Err: res.lookupErr})
+	return res.lookupErr
 }
 
-// Refresh refreshes IP list cache.
+// Refresh re-resolves cached entries and evicts ones that have gone idle
+// (unused for longer than idleWindow) or that push the cache past maxEntries.
 func (r *Resolver) Refresh() {
-	r.lock.RLock()
-	addrs := make([]string, 0, len(r.cache))
-	for addr := range r.cache {
+	now := time.Now()
+
+	addrs := make([]string, 0, cacheSize)
+	r.cache.Range(func(key, value interface{}) bool {
+		addr := key.(string)
+		entry := value.(*cacheEntry)
+		if now.Sub(entry.lastUsedAt()) > r.idleWindow {
+			r.cache.Delete(addr)
+			r.metrics.IncEviction()
+			return true
+		}
 		addrs = append(addrs, addr)
-	}
-	r.lock.RUnlock()
+		return true
+	})
 
 	for _, addr := range addrs {
 		ctx, cancelF := context.WithTimeout(context.Background(), r.lookupTimeout)
-		if _, err := r.LookupIP(ctx, addr); err != nil {
+		if err := r.refreshHost(ctx, addr); err != nil {
 			r.logger.WithFields(logrus.Fields{
 				"error": err,
 				"addr":  addr,
@@ -145,6 +462,52 @@ func (r *Resolver) Refresh() {
 		}
 		cancelF()
 	}
+
+	// Enforce the LRU cap only after refreshing, so a re-resolved entry isn't
+	// immediately re-inserted past capacity by the loop above.
+	r.evictLRU()
+
+	r.metrics.SetCacheSize(r.cacheLen())
+}
+
+// cacheLen counts the current number of entries in the cache.
+func (r *Resolver) cacheLen() int {
+	n := 0
+	r.cache.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// evictLRU drops the least-recently-used entries until the cache is at or
+// under maxEntries.
+func (r *Resolver) evictLRU() {
+	if r.maxEntries <= 0 {
+		return
+	}
+
+	type keyAge struct {
+		addr     string
+		lastUsed time.Time
+	}
+	var entries []keyAge
+	r.cache.Range(func(key, value interface{}) bool {
+		entries = append(entries, keyAge{key.(string), value.(*cacheEntry).lastUsedAt()})
+		return true
+	})
+	if len(entries) <= r.maxEntries {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	for _, e := range entries[:len(entries)-r.maxEntries] {
+		r.cache.Delete(e.addr)
+		r.metrics.IncEviction()
+	}
 }
 
 // Stop stops auto refreshing.
@@ -156,3 +519,53 @@ func (r *Resolver) Stop() {
 		r.closer = nil
 	}
 }
+
+// Invalidate removes addr from the cache so the next Fetch re-resolves it from DNS.
+func (r *Resolver) Invalidate(addr string) {
+	r.cache.Delete(addr)
+}
+
+// DialContext matches the signature of http.Transport.DialContext, letting a
+// DNS-cache-aware dialer be plugged directly into the reverse-proxy transport
+// the firewall uses to reach upstreams.
+type DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContextWithDNSCache wraps base with a DialContext that resolves the host
+// portion of addr through r instead of letting base (and, transitively, the
+// standard resolver) hit DNS on every dial. Cached IPs are tried in a
+// randomized order so load is spread across A/AAAA records (a poor man's
+// happy-eyeballs), falling through to the next IP on failure. If every IP
+// fails, the cache entry is invalidated so the next dial re-resolves the host.
+func DialContextWithDNSCache(r DNSCache, base DialContext) DialContext {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return base(ctx, network, addr)
+		}
+
+		ips, err := r.Fetch(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return base(ctx, network, addr)
+		}
+
+		var firstErr error
+		for _, i := range rand.Perm(len(ips)) {
+			conn, err := base(ctx, network, net.JoinHostPort(ips[i].String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		// every cached IP failed to dial: the cache entry is likely stale, so
+		// drop it and let the next dial re-resolve the host from scratch.
+		r.Invalidate(host)
+
+		return nil, firstErr
+	}
+}
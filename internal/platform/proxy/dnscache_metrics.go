@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// Metrics is the set of instrumentation hooks a Resolver reports to. It's
+// deliberately narrow so the existing Prometheus registry used elsewhere in
+// the firewall can back it with counters/histograms/gauges without this
+// package importing the Prometheus client directly.
+type Metrics interface {
+	// IncLookups counts every DNS lookup that actually reaches the resolver
+	// -- i.e. once per group of callers coalesced by singleflight, not once
+	// per caller. Compare against IncSingleflightDedup to see how much
+	// duplicate traffic coalescing is absorbing.
+	IncLookups()
+	IncCacheHit()
+	IncCacheMiss()
+	IncRefreshSuccess()
+	IncRefreshFailure()
+	IncEviction()
+	// IncSingleflightDedup counts a lookup that was served by an
+	// already-in-flight call for the same host instead of hitting DNS again.
+	IncSingleflightDedup()
+	// ObserveLookupDuration reports how long a DNS lookup round-trip took.
+	ObserveLookupDuration(d time.Duration)
+	// SetCacheSize reports the current number of entries held in the cache.
+	SetCacheSize(n int)
+}
+
+// noopMetrics is the default Metrics used when a Resolver is constructed
+// without one.
+type noopMetrics struct{}
+
+func (noopMetrics) IncLookups()                           {}
+func (noopMetrics) IncCacheHit()                          {}
+func (noopMetrics) IncCacheMiss()                         {}
+func (noopMetrics) IncRefreshSuccess()                    {}
+func (noopMetrics) IncRefreshFailure()                    {}
+func (noopMetrics) IncEviction()                          {}
+func (noopMetrics) IncSingleflightDedup()                 {}
+func (noopMetrics) ObserveLookupDuration(_ time.Duration) {}
+func (noopMetrics) SetCacheSize(_ int)                    {}
+
+// RefreshStats describes the outcome of refreshing a single cached host,
+// passed to the callback registered with Resolver.OnRefresh.
+type RefreshStats struct {
+	Host   string
+	OldIPs []net.IP
+	NewIPs []net.IP
+	Err    error
+}
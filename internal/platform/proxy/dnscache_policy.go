@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPolicyTimeout bounds how long a single PolicyResolver lookup (primary
+// and fallback combined) is allowed to take.
+var defaultPolicyTimeout = 2 * time.Second
+
+// ErrFilteredByPolicy is returned when every resolver answer for a lookup was
+// rejected by the rule's IPFilter (e.g. a DNS answer outside the expected
+// subnet, a sign of DNS poisoning or split-horizon misconfiguration).
+var ErrFilteredByPolicy = errors.New("proxy: resolved IPs rejected by policy IP filter")
+
+// IPFilter validates resolved IPs against CIDR allow/deny lists. A nil
+// IPFilter, or one with both lists empty, allows any non-empty answer.
+type IPFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Allows reports whether every IP in ips is permitted by f. An empty ips
+// slice is never allowed, since a lookup that resolved to nothing can't be
+// routed anywhere.
+func (f *IPFilter) Allows(ips []net.IP) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	if f == nil {
+		return true
+	}
+	for _, ip := range ips {
+		if !f.allowsOne(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *IPFilter) allowsOne(ip net.IP) bool {
+	for _, n := range f.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, n := range f.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainRule routes lookups for hostnames matching Suffix to Primary, falling
+// back to Fallback (if set) when Primary fails or its answer doesn't pass
+// Filter. Rules are evaluated in order, so more specific suffixes should come
+// first in PolicyConfig.Rules.
+type DomainRule struct {
+	// Suffix matches a hostname equal to it, or ending in "."+Suffix, e.g.
+	// Suffix "internal.corp" matches "internal.corp" and "db.internal.corp"
+	// but not "notinternal.corp".
+	Suffix   string
+	Primary  DNSCache
+	Fallback DNSCache
+	Filter   *IPFilter
+	// Timeout bounds Primary and Fallback combined. Defaults to
+	// defaultPolicyTimeout when zero.
+	Timeout time.Duration
+}
+
+func (r DomainRule) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultPolicyTimeout
+	}
+	return r.Timeout
+}
+
+// PolicyConfig describes split-horizon DNS routing for a PolicyResolver:
+// per-suffix rules plus a Default rule used when no suffix matches.
+type PolicyConfig struct {
+	Rules   []DomainRule
+	Default DomainRule
+}
+
+// PolicyResolver is a DNSCache that dispatches lookups to different resolver
+// backends based on domain-suffix rules, validating answers against an
+// IPFilter and only consulting a fallback resolver when the primary fails or
+// its answer is filtered out. This enables split-horizon DNS (internal names
+// resolved by an internal resolver, public names by a public one) and guards
+// against DNS poisoning by rejecting answers outside the expected subnets.
+type PolicyResolver struct {
+	cfg    PolicyConfig
+	logger *logrus.Logger
+}
+
+// NewPolicyResolver builds a PolicyResolver from cfg.
+func NewPolicyResolver(cfg PolicyConfig, logger *logrus.Logger) *PolicyResolver {
+	return &PolicyResolver{cfg: cfg, logger: logger}
+}
+
+// ruleFor returns the first rule whose Suffix matches addr, or cfg.Default.
+func (p *PolicyResolver) ruleFor(addr string) DomainRule {
+	for _, rule := range p.cfg.Rules {
+		if domainMatches(addr, rule.Suffix) {
+			return rule
+		}
+	}
+	return p.cfg.Default
+}
+
+// domainMatches reports whether host equals suffix or is a subdomain of it.
+func domainMatches(host, suffix string) bool {
+	if suffix == "" {
+		return false
+	}
+	host = strings.TrimSuffix(host, ".")
+	suffix = strings.TrimSuffix(suffix, ".")
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+type policyLookupFn func(r DNSCache, ctx context.Context, addr string) ([]net.IP, error)
+
+// resolve fires Primary first and only consults Fallback (if configured) when
+// Primary errors or its answer is rejected by the rule's IPFilter, both bound
+// by the rule's overall timeout. This keeps hostnames matched to Primary off
+// Fallback entirely on the common path, preserving split-horizon routing and
+// avoiding doubling query load onto the fallback resolver.
+func (p *PolicyResolver) resolve(ctx context.Context, addr string, lookup policyLookupFn) ([]net.IP, error) {
+	rule := p.ruleFor(addr)
+	if rule.Primary == nil {
+		return nil, errors.New("proxy: no resolver configured for " + addr)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, rule.timeout())
+	defer cancel()
+
+	primaryIPs, primaryErr := lookup(rule.Primary, cctx, addr)
+	if primaryErr == nil && rule.Filter.Allows(primaryIPs) {
+		return primaryIPs, nil
+	}
+
+	if rule.Fallback == nil {
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+		return nil, ErrFilteredByPolicy
+	}
+
+	fallbackIPs, fallbackErr := lookup(rule.Fallback, cctx, addr)
+	if fallbackErr == nil && rule.Filter.Allows(fallbackIPs) {
+		return fallbackIPs, nil
+	}
+
+	if fallbackErr != nil {
+		return nil, fallbackErr
+	}
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, ErrFilteredByPolicy
+}
+
+// LookupIP implements DNSCache by dispatching to the matching rule's
+// resolvers per the primary/fallback model described on PolicyResolver.
+func (p *PolicyResolver) LookupIP(ctx context.Context, addr string) ([]net.IP, error) {
+	return p.resolve(ctx, addr, DNSCache.LookupIP)
+}
+
+// Fetch implements DNSCache by dispatching to the matching rule's resolvers
+// per the primary/fallback model described on PolicyResolver.
+func (p *PolicyResolver) Fetch(ctx context.Context, addr string) ([]net.IP, error) {
+	return p.resolve(ctx, addr, DNSCache.Fetch)
+}
+
+// forEachResolver calls fn once for every distinct resolver referenced by the
+// policy's rules.
+func (p *PolicyResolver) forEachResolver(fn func(DNSCache)) {
+	seen := make(map[DNSCache]struct{})
+	visit := func(r DNSCache) {
+		if r == nil {
+			return
+		}
+		if _, ok := seen[r]; ok {
+			return
+		}
+		seen[r] = struct{}{}
+		fn(r)
+	}
+
+	for _, rule := range p.cfg.Rules {
+		visit(rule.Primary)
+		visit(rule.Fallback)
+	}
+	visit(p.cfg.Default.Primary)
+	visit(p.cfg.Default.Fallback)
+}
+
+// Refresh refreshes every distinct resolver backing the policy.
+func (p *PolicyResolver) Refresh() {
+	p.forEachResolver(func(r DNSCache) { r.Refresh() })
+}
+
+// Stop stops every distinct resolver backing the policy.
+func (p *PolicyResolver) Stop() {
+	p.forEachResolver(func(r DNSCache) { r.Stop() })
+}
+
+// Invalidate invalidates addr in the matching rule's primary and fallback
+// resolvers.
+func (p *PolicyResolver) Invalidate(addr string) {
+	rule := p.ruleFor(addr)
+	if rule.Primary != nil {
+		rule.Primary.Invalidate(addr)
+	}
+	if rule.Fallback != nil {
+		rule.Fallback.Invalidate(addr)
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return n
+}
+
+func staticFetchCache(ips []net.IP, err error) *fakeDNSCache {
+	return &fakeDNSCache{fetchFn: func(ctx context.Context, addr string) ([]net.IP, error) {
+		return ips, err
+	}}
+}
+
+func TestPolicyResolverPrefersPrimaryAndSkipsFallbackOnSuccess(t *testing.T) {
+	primary := staticFetchCache([]net.IP{net.ParseIP("10.0.0.1")}, nil)
+	fallback := staticFetchCache([]net.IP{net.ParseIP("203.0.113.1")}, nil)
+
+	p := NewPolicyResolver(PolicyConfig{
+		Default: DomainRule{Primary: primary, Fallback: fallback, Timeout: time.Second},
+	}, testLogger())
+
+	ips, err := p.Fetch(context.Background(), "internal.corp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected primary's answer, got %v", ips)
+	}
+	if fallback.calls() != 0 {
+		t.Fatalf("expected fallback not to be consulted when primary succeeds, got %d calls", fallback.calls())
+	}
+}
+
+func TestPolicyResolverFallsBackOnPrimaryError(t *testing.T) {
+	primary := staticFetchCache(nil, errTestLookup)
+	fallback := staticFetchCache([]net.IP{net.ParseIP("203.0.113.1")}, nil)
+
+	p := NewPolicyResolver(PolicyConfig{
+		Default: DomainRule{Primary: primary, Fallback: fallback, Timeout: time.Second},
+	}, testLogger())
+
+	ips, err := p.Fetch(context.Background(), "public.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("203.0.113.1")) {
+		t.Fatalf("expected fallback's answer, got %v", ips)
+	}
+	if fallback.calls() != 1 {
+		t.Fatalf("expected fallback to be consulted exactly once, got %d calls", fallback.calls())
+	}
+}
+
+func TestPolicyResolverFallsBackWhenPrimaryAnswerIsFiltered(t *testing.T) {
+	primary := staticFetchCache([]net.IP{net.ParseIP("198.51.100.1")}, nil)
+	fallback := staticFetchCache([]net.IP{net.ParseIP("10.0.0.5")}, nil)
+
+	p := NewPolicyResolver(PolicyConfig{
+		Default: DomainRule{
+			Primary:  primary,
+			Fallback: fallback,
+			Timeout:  time.Second,
+			Filter:   &IPFilter{Allow: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}},
+		},
+	}, testLogger())
+
+	ips, err := p.Fetch(context.Background(), "internal.corp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("expected fallback's answer after primary was filtered, got %v", ips)
+	}
+}
+
+func TestPolicyResolverNoFallbackReturnsFilteredError(t *testing.T) {
+	primary := staticFetchCache([]net.IP{net.ParseIP("198.51.100.1")}, nil)
+
+	p := NewPolicyResolver(PolicyConfig{
+		Default: DomainRule{
+			Primary: primary,
+			Timeout: time.Second,
+			Filter:  &IPFilter{Allow: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}},
+		},
+	}, testLogger())
+
+	_, err := p.Fetch(context.Background(), "internal.corp")
+	if err != ErrFilteredByPolicy {
+		t.Fatalf("expected ErrFilteredByPolicy, got %v", err)
+	}
+}
+
+func TestPolicyResolverDomainSuffixRouting(t *testing.T) {
+	internal := staticFetchCache([]net.IP{net.ParseIP("10.0.0.9")}, nil)
+	public := staticFetchCache([]net.IP{net.ParseIP("203.0.113.9")}, nil)
+
+	p := NewPolicyResolver(PolicyConfig{
+		Rules: []DomainRule{
+			{Suffix: "internal.corp", Primary: internal, Timeout: time.Second},
+		},
+		Default: DomainRule{Primary: public, Timeout: time.Second},
+	}, testLogger())
+
+	ips, err := p.Fetch(context.Background(), "db.internal.corp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ips[0].Equal(net.ParseIP("10.0.0.9")) {
+		t.Fatalf("expected internal rule to be used, got %v", ips)
+	}
+
+	ips, err = p.Fetch(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ips[0].Equal(net.ParseIP("203.0.113.9")) {
+		t.Fatalf("expected default rule to be used, got %v", ips)
+	}
+}
+
+func TestIPFilterAllows(t *testing.T) {
+	filter := &IPFilter{
+		Allow: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")},
+		Deny:  []*net.IPNet{mustCIDR(t, "10.1.0.0/16")},
+	}
+
+	tests := []struct {
+		name string
+		ips  []net.IP
+		want bool
+	}{
+		{"allowed subnet", []net.IP{net.ParseIP("10.2.0.1")}, true},
+		{"denied subnet wins over allow", []net.IP{net.ParseIP("10.1.0.1")}, false},
+		{"outside allow list", []net.IP{net.ParseIP("203.0.113.1")}, false},
+		{"empty answer never passes", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filter.Allows(tt.ips); got != tt.want {
+				t.Fatalf("Allows(%v) = %v, want %v", tt.ips, got, tt.want)
+			}
+		})
+	}
+}
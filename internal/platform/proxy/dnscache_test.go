@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(discardWriter{})
+	return logger
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// newTestResolver builds a Resolver directly (bypassing NewDNSResolver's real
+// net.Resolver) so lookups are driven by lookupFn instead of hitting the
+// network.
+func newTestResolver(lookupFn func(ctx context.Context, host string) ([]net.IP, error), ttl, negativeTTL, graceWindow, idleWindow time.Duration, maxEntries int) *Resolver {
+	return &Resolver{
+		lookupIPFn:    lookupFn,
+		lookupTimeout: time.Second,
+		ttl:           ttl,
+		negativeTTL:   negativeTTL,
+		graceWindow:   graceWindow,
+		idleWindow:    idleWindow,
+		maxEntries:    maxEntries,
+		logger:        testLogger(),
+		metrics:       noopMetrics{},
+	}
+}
+
+func TestResolverTTLExpiry(t *testing.T) {
+	var calls int32
+	ip := net.ParseIP("10.0.0.1")
+
+	r := newTestResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		atomic.AddInt32(&calls, 1)
+		return []net.IP{ip}, nil
+	}, 20*time.Millisecond, 5*time.Millisecond, 0, time.Hour, 0)
+
+	ips, err := r.Fetch(context.Background(), "example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("unexpected first Fetch result: ips=%v err=%v", ips, err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected 1 lookup, got %d", got)
+	}
+
+	// Within TTL, a second Fetch must be served from cache without a new lookup.
+	if _, err := r.Fetch(context.Background(), "example.com"); err != nil {
+		t.Fatalf("unexpected error on cached Fetch: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected cached Fetch to skip lookup, got %d calls", got)
+	}
+
+	// Past TTL (and with no grace window), Fetch must re-resolve synchronously.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := r.Fetch(context.Background(), "example.com"); err != nil {
+		t.Fatalf("unexpected error on expired Fetch: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("expected expired Fetch to trigger a re-lookup, got %d calls", got)
+	}
+}
+
+func TestResolverNegativeTTLIsShorter(t *testing.T) {
+	var calls int32
+	failUntil := int32(1)
+
+	r := newTestResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n <= failUntil {
+			return nil, errTestLookup
+		}
+		return []net.IP{net.ParseIP("10.0.0.2")}, nil
+	}, time.Hour, 10*time.Millisecond, 0, time.Hour, 0)
+
+	if _, err := r.Fetch(context.Background(), "broken.example.com"); err == nil {
+		t.Fatal("expected first lookup to fail")
+	}
+
+	// The negative TTL is much shorter than the positive TTL; after it elapses
+	// the next Fetch must retry instead of continuing to serve the error.
+	time.Sleep(20 * time.Millisecond)
+	ips, err := r.Fetch(context.Background(), "broken.example.com")
+	if err != nil {
+		t.Fatalf("expected retry after negative TTL to succeed, got err=%v", err)
+	}
+	if len(ips) != 1 {
+		t.Fatalf("expected one resolved IP, got %v", ips)
+	}
+}
+
+func TestResolverPersistsGoodEntryOnRefreshFailure(t *testing.T) {
+	var calls int32
+	goodIP := net.ParseIP("10.0.0.5")
+
+	r := newTestResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return []net.IP{goodIP}, nil
+		}
+		return nil, errTestLookup
+	}, time.Hour, 10*time.Millisecond, 0, time.Hour, 0)
+
+	if _, err := r.Fetch(context.Background(), "flaky.example.com"); err != nil {
+		t.Fatalf("unexpected error on first Fetch: %v", err)
+	}
+
+	// A failed refresh must keep serving the last good answer instead of
+	// replacing it with the error (persist-on-failure), and must still report
+	// the real failure to RefreshStats/metrics.
+	var stats RefreshStats
+	r.OnRefresh(func(s RefreshStats) { stats = s })
+	if err := r.refreshHost(context.Background(), "flaky.example.com"); err == nil {
+		t.Fatal("expected refreshHost to report the underlying lookup failure")
+	}
+	if stats.Err == nil {
+		t.Fatal("expected RefreshStats to carry the real lookup error")
+	}
+
+	ips, err := r.Fetch(context.Background(), "flaky.example.com")
+	if err != nil {
+		t.Fatalf("expected Fetch to keep serving the last good answer, got err=%v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(goodIP) {
+		t.Fatalf("expected persisted good answer %v, got %v", goodIP, ips)
+	}
+}
+
+func TestResolverDoesNotNegativeCacheContextCancellation(t *testing.T) {
+	r := newTestResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		return nil, context.Canceled
+	}, time.Hour, time.Hour, 0, time.Hour, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Fetch(ctx, "cancelled.example.com"); err == nil {
+		t.Fatal("expected the cancellation error to propagate")
+	}
+	if _, ok := r.cache.Load("cancelled.example.com"); ok {
+		t.Fatal("expected a cancelled lookup not to be cached at all")
+	}
+}
+
+func TestResolverSingleflightInFlightCounterDoesNotLeak(t *testing.T) {
+	r := newTestResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.6")}, nil
+	}, time.Hour, time.Hour, 0, time.Hour, 0)
+
+	if _, err := r.resolve(context.Background(), "once.example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := r.sfInFlight.Load("once.example.com"); ok {
+		t.Fatal("expected sfInFlight counter to be removed once no caller is waiting")
+	}
+}
+
+var errTestLookup = &net.DNSError{Err: "simulated failure", IsNotFound: true}
+
+func TestResolverLRUCapSurvivesRefresh(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.3")}, nil
+	}
+
+	r := newTestResolver(lookup, time.Hour, time.Hour, 0, time.Hour, 2)
+
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		if _, err := r.Fetch(context.Background(), host); err != nil {
+			t.Fatalf("Fetch(%s): %v", host, err)
+		}
+	}
+	if got := r.cacheLen(); got != 3 {
+		t.Fatalf("expected 3 entries before Refresh, got %d", got)
+	}
+
+	// Refresh must enforce maxEntries by LRU, and the evicted entries must not
+	// be resurrected by the same refresh pass (the bug this test guards
+	// against: building the refresh list before eviction runs, so an evicted
+	// host was immediately re-resolved and re-inserted in the same tick).
+	r.Refresh()
+	if got := r.cacheLen(); got != 2 {
+		t.Fatalf("expected cache capped at 2 entries after Refresh, got %d", got)
+	}
+}
+
+func TestResolverIdleWindowEviction(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.4")}, nil
+	}
+
+	r := newTestResolver(lookup, time.Hour, time.Hour, 0, 10*time.Millisecond, 0)
+
+	if _, err := r.Fetch(context.Background(), "idle.example.com"); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	r.Refresh()
+
+	if _, ok := r.cache.Load("idle.example.com"); ok {
+		t.Fatal("expected idle entry to be evicted by Refresh")
+	}
+}
+
+func TestFilterIPsByFamily(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+	ips := []net.IP{v4, v6}
+
+	tests := []struct {
+		name               string
+		ipv4Only, ipv6Only bool
+		want               []net.IP
+	}{
+		{"no filter", false, false, []net.IP{v4, v6}},
+		{"both set behaves as no filter", true, true, []net.IP{v4, v6}},
+		{"ipv4 only", true, false, []net.IP{v4}},
+		{"ipv6 only", false, true, []net.IP{v6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterIPsByFamily(ips, tt.ipv4Only, tt.ipv6Only)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// fakeDNSCache is a minimal DNSCache test double whose Fetch behavior is
+// driven by a closure, with call counts for assertions.
+type fakeDNSCache struct {
+	mu          sync.Mutex
+	fetchCalls  int
+	fetchFn     func(ctx context.Context, addr string) ([]net.IP, error)
+	invalidated []string
+}
+
+func (f *fakeDNSCache) LookupIP(ctx context.Context, addr string) ([]net.IP, error) {
+	return f.Fetch(ctx, addr)
+}
+
+func (f *fakeDNSCache) Fetch(ctx context.Context, addr string) ([]net.IP, error) {
+	f.mu.Lock()
+	f.fetchCalls++
+	f.mu.Unlock()
+	return f.fetchFn(ctx, addr)
+}
+
+func (f *fakeDNSCache) Refresh() {}
+func (f *fakeDNSCache) Stop()    {}
+func (f *fakeDNSCache) Invalidate(addr string) {
+	f.mu.Lock()
+	f.invalidated = append(f.invalidated, addr)
+	f.mu.Unlock()
+}
+
+func (f *fakeDNSCache) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetchCalls
+}
+
+func TestDialContextWithDNSCacheTriesEachIPAndInvalidatesOnTotalFailure(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11"), net.ParseIP("10.0.0.12")}
+	cache := &fakeDNSCache{fetchFn: func(ctx context.Context, addr string) ([]net.IP, error) {
+		return ips, nil
+	}}
+
+	var attempted []string
+	var mu sync.Mutex
+	base := DialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		attempted = append(attempted, addr)
+		mu.Unlock()
+		return nil, errDialFailed
+	})
+
+	dial := DialContextWithDNSCache(cache, base)
+	_, err := dial(context.Background(), "tcp", "example.com:443")
+	if err == nil {
+		t.Fatal("expected an error when every IP fails to dial")
+	}
+
+	mu.Lock()
+	gotAttempts := len(attempted)
+	mu.Unlock()
+	if gotAttempts != len(ips) {
+		t.Fatalf("expected every cached IP to be attempted, got %d attempts", gotAttempts)
+	}
+	if len(cache.invalidated) != 1 || cache.invalidated[0] != "example.com" {
+		t.Fatalf("expected cache entry to be invalidated on total failure, got %v", cache.invalidated)
+	}
+}
+
+func TestDialContextWithDNSCacheReturnsFirstSuccess(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.20"), net.ParseIP("10.0.0.21")}
+	cache := &fakeDNSCache{fetchFn: func(ctx context.Context, addr string) ([]net.IP, error) {
+		return ips, nil
+	}}
+
+	wantConn := &net.TCPConn{}
+	base := DialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return wantConn, nil
+	})
+
+	dial := DialContextWithDNSCache(cache, base)
+	conn, err := dial(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn != wantConn {
+		t.Fatalf("expected the dialed connection to be returned")
+	}
+	if len(cache.invalidated) != 0 {
+		t.Fatalf("expected no invalidation on success, got %v", cache.invalidated)
+	}
+}
+
+var errDialFailed = &net.OpError{Op: "dial", Err: errTestLookup}